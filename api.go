@@ -17,6 +17,8 @@ package api
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +29,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -35,15 +38,30 @@ type CacophonyClient struct {
 	name           string
 	password       string
 	token          string
+	tokenMu        sync.RWMutex
 	justRegistered bool
 }
 
+func (c *CacophonyClient) getToken() string {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.token
+}
+
+func (c *CacophonyClient) setToken(token string) {
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
+	c.token = token
+}
+
 type CacophonyAPI struct {
-	Client     *CacophonyClient
-	httpClient *http.Client
-	serverURL  string
-	regURL     string
-	authURL    string
+	Client      *CacophonyClient
+	httpClient  *http.Client
+	serverURL   string
+	regURL      string
+	authURL     string
+	refreshMu   sync.Mutex
+	tlsReloader *tlsReloader
 }
 
 func (api *CacophonyAPI) Password() string {
@@ -58,26 +76,44 @@ const httpTimeout = 60 * time.Second
 const timeout = 30 * time.Second
 const basePath = "/api/v1"
 
+// maxRequestAttempts is the number of times doRequest will try a request,
+// including the initial attempt, before giving up. A 401/403 consumes one
+// re-authentication but not one of these retries.
+const maxRequestAttempts = 4
+
+// retryBaseDelay is the initial sleep between retried attempts. It doubles
+// after each retry (simple exponential backoff).
+const retryBaseDelay = 500 * time.Millisecond
+
 // NewAPI creates a CacophonyAPI instance and obtains a fresh JSON Web
-// Token. If no password is given then the device is registered.
-func NewAPI(serverURL, group, deviceName, password string) (*CacophonyAPI, error) {
+// Token. If no password is given then the device is registered. conf's
+// optional TLS fields (CACert, ClientCert, ClientKey, InsecureSkipVerify,
+// ServerPinSHA256) configure how the underlying http.Client talks to
+// conf.ServerURL.
+func NewAPI(conf *Config, password string) (*CacophonyAPI, error) {
 
-	if deviceName == "" {
+	if conf.DeviceName == "" {
 		return nil, errors.New("no device name")
 	}
 
+	httpClient, reloader, err := newHTTPClient(conf)
+	if err != nil {
+		return nil, fmt.Errorf("new http client: %w", err)
+	}
+
 	client := &CacophonyClient{
-		group:    group,
-		name:     deviceName,
+		group:    conf.Group,
+		name:     conf.DeviceName,
 		password: password,
 	}
 
 	api := &CacophonyAPI{
-		serverURL:  serverURL,
-		Client:     client,
-		httpClient: newHTTPClient(),
-		regURL:     serverURL + basePath + "/devices",
-		authURL:    serverURL + "/authenticate_device",
+		serverURL:   conf.ServerURL,
+		Client:      client,
+		httpClient:  httpClient,
+		regURL:      conf.ServerURL + basePath + "/devices",
+		authURL:     conf.ServerURL + "/authenticate_device",
+		tlsReloader: reloader,
 	}
 
 	//api.typeName = deviceName
@@ -103,14 +139,14 @@ func NewAPI(serverURL, group, deviceName, password string) (*CacophonyAPI, error
 func (api *CacophonyAPI) authenticate() error {
 
 	if api.Client.password == "" {
-		return errors.New("no password set")
+		return fmt.Errorf("authenticate: %w: no password set", ErrAuthFailed)
 	}
 	payload, err := json.Marshal(map[string]string{
 		"devicename": api.Client.name,
 		"password":   api.Client.password,
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("authenticate: marshal: %w", err)
 	}
 	postResp, err := api.httpClient.Post(
 		api.authURL,
@@ -118,27 +154,92 @@ func (api *CacophonyAPI) authenticate() error {
 		bytes.NewReader(payload),
 	)
 	if err != nil {
-		return err
+		return temporaryError(fmt.Errorf("authenticate: post %s: %w", api.authURL, err))
 	}
 	defer postResp.Body.Close()
 
 	if err := handleHTTPResponse(postResp); err != nil {
-		return err
+		return fmt.Errorf("authenticate: %w", err)
 	}
 
 	var resp tokenResponse
 	d := json.NewDecoder(postResp.Body)
 	if err := d.Decode(&resp); err != nil {
-		return fmt.Errorf("decode: %v", err)
+		return fmt.Errorf("authenticate: decode: %w", err)
 	}
 	if !resp.Success {
-		return fmt.Errorf("failed getting new token: %v", resp.message())
+		return fmt.Errorf("authenticate: %w: %s", ErrAuthFailed, resp.message())
 	}
-	api.Client.token = resp.Token
+	api.Client.setToken(resp.Token)
 	return nil
 }
 
-func newHTTPClient() *http.Client {
+// reauthenticate re-authenticates with the stored password to obtain a
+// fresh token. It is safe for concurrent callers sharing one CacophonyAPI:
+// only one re-authentication happens at a time, and callers that queue up
+// behind refreshMu each run their own authenticate once they hold it.
+func (api *CacophonyAPI) reauthenticate() error {
+	api.refreshMu.Lock()
+	defer api.refreshMu.Unlock()
+	return api.authenticate()
+}
+
+// doRequest sends the request built by newReq, transparently re-
+// authenticating and retrying once if the server responds with 401/403,
+// and retrying transient network errors and 5xx responses with
+// exponential backoff. newReq is called again for every attempt so the
+// request body can be rebuilt from scratch.
+func (api *CacophonyAPI) doRequest(newReq func() (*http.Request, error)) (*http.Response, error) {
+	reauthed := false
+	delay := retryBaseDelay
+	for attempt := 1; ; attempt++ {
+		req, err := newReq()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", api.Client.getToken())
+
+		resp, err := api.httpClient.Do(req)
+		if err != nil {
+			if attempt >= maxRequestAttempts {
+				return nil, temporaryError(fmt.Errorf("request failed: %w", err))
+			}
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		if !reauthed && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			resp.Body.Close()
+			reauthed = true
+			if err := api.reauthenticate(); err != nil {
+				return nil, fmt.Errorf("%w: reauthenticate failed: %w", ErrTokenExpired, err)
+			}
+			attempt--
+			continue
+		}
+
+		if resp.StatusCode >= 500 && attempt < maxRequestAttempts {
+			resp.Body.Close()
+			time.Sleep(delay)
+			delay *= 2
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// newHTTPClient builds the http.Client used for all API requests, along
+// with the tlsReloader watching it for SIGHUP. The reloader is returned so
+// the caller can stop its background goroutine via CacophonyAPI.Close.
+func newHTTPClient(conf *Config) (*http.Client, *tlsReloader, error) {
+	reloader, err := newTLSReloader(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	reloader.watchSIGHUP()
+
 	return &http.Client{
 		Transport: &http.Transport{
 			Proxy: http.ProxyFromEnvironment,
@@ -153,14 +254,35 @@ func newHTTPClient() *http.Client {
 			ExpectContinueTimeout: 1 * time.Second,
 			MaxIdleConns:          5,
 			IdleConnTimeout:       90 * time.Second,
+			// DialTLSContext takes the reloader's current config on every
+			// connection, so a SIGHUP-triggered cert reload takes effect
+			// without rebuilding the Transport.
+			DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				cfg := reloader.get().Clone()
+				if cfg.ServerName == "" {
+					cfg.ServerName, _, _ = net.SplitHostPort(addr)
+				}
+				d := &tls.Dialer{NetDialer: &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}, Config: cfg}
+				return d.DialContext(ctx, network, addr)
+			},
 		},
+	}, reloader, nil
+}
+
+// Close stops the background goroutine that watches for SIGHUP to reload
+// TLS certs/keys. Callers that create more than one CacophonyAPI over
+// their lifetime (reconnects, tests, config reload) should Close the old
+// one first, or it leaks a goroutine and a registered signal channel.
+func (api *CacophonyAPI) Close() {
+	if api.tlsReloader != nil {
+		api.tlsReloader.stop()
 	}
 }
 
 //register a device on the cacophony server and retrieves it's token
 func (api *CacophonyAPI) register() error {
 	if api.Client.password != "" {
-		return errors.New("already registered")
+		return errors.New("register: already registered")
 	}
 
 	password := randString(20)
@@ -170,7 +292,7 @@ func (api *CacophonyAPI) register() error {
 		"password":   password,
 	})
 	if err != nil {
-		return err
+		return fmt.Errorf("register: marshal: %w", err)
 	}
 	postResp, err := api.httpClient.Post(
 		api.regURL,
@@ -178,72 +300,77 @@ func (api *CacophonyAPI) register() error {
 		bytes.NewReader(payload),
 	)
 	if err != nil {
-		return err
+		return temporaryError(fmt.Errorf("register: post %s: %w", api.regURL, err))
 	}
 	defer postResp.Body.Close()
 
 	if err := handleHTTPResponse(postResp); err != nil {
-		return err
+		return fmt.Errorf("register: %w", err)
 	}
 
 	var respData tokenResponse
 	d := json.NewDecoder(postResp.Body)
 	if err := d.Decode(&respData); err != nil {
-		return fmt.Errorf("decode: %v", err)
+		return fmt.Errorf("register: decode: %w", err)
 	}
 	if !respData.Success {
-		return fmt.Errorf("registration failed: %v", respData.message())
+		return fmt.Errorf("register: %w: %s", ErrAuthFailed, respData.message())
 	}
 
 	api.Client.password = password
-	api.Client.token = respData.Token
+	api.Client.setToken(respData.Token)
 	api.Client.justRegistered = true
 
 	return nil
 }
 
-// UploadThermalRaw uploads the file to the api server as a multipartmessage
-// with data of type thermalRaw specified
+// UploadThermalRaw uploads the file to the api server as a multipart
+// message with data of type thermalRaw specified. Unlike
+// UploadThermalRawStream it buffers the whole body first, which costs
+// memory but means the request can be rebuilt and retried by doRequest -
+// so, unlike the stream, it gets transparent 401 re-auth and 5xx
+// backoff. Kept for existing callers that don't need resumability.
 func (api *CacophonyAPI) UploadThermalRaw(r io.Reader) error {
 	buf := new(bytes.Buffer)
 	w := multipart.NewWriter(buf)
 
-	// JSON encoded "data" parameter.
-	dataBuf, err := json.Marshal(map[string]string{
-		"type": "thermalRaw",
-	})
+	dataBuf, err := json.Marshal(UploadMeta{Type: "thermalRaw"})
 	if err != nil {
-		return err
+		return fmt.Errorf("upload thermal raw: %w", err)
 	}
 	if err := w.WriteField("data", string(dataBuf)); err != nil {
-		return err
+		return fmt.Errorf("upload thermal raw: %w", err)
 	}
-
-	// Add the file as a new MIME part.
 	fw, err := w.CreateFormFile("file", "file")
 	if err != nil {
-		return err
+		return fmt.Errorf("upload thermal raw: %w", err)
 	}
-	io.Copy(fw, r)
-	w.Close()
-
-	req, err := http.NewRequest("POST", api.serverURL+basePath+"/recordings", buf)
-	if err != nil {
-		return err
+	if _, err := io.Copy(fw, r); err != nil {
+		return fmt.Errorf("upload thermal raw: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("upload thermal raw: %w", err)
 	}
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	req.Header.Set("Authorization", api.Client.token)
 
-	resp, err := api.httpClient.Do(req)
+	body := buf.Bytes()
+	contentType := w.FormDataContentType()
+
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", api.serverURL+basePath+"/recordings", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("upload thermal raw: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if err := handleHTTPResponse(resp); err != nil {
-		return err
+		return fmt.Errorf("upload thermal raw: %w", err)
 	}
-
 	return nil
 }
 
@@ -263,26 +390,27 @@ func (r *tokenResponse) message() string {
 func (api *CacophonyAPI) getFileFromJWT(jwt, path string) error {
 	out, err := os.Create(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("get file: create %s: %w", path, err)
 	}
 	defer out.Close()
 
 	// Get the data
-	resp, err := http.Get(api.serverURL + basePath + "/signedUrl?jwt=" + jwt)
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", api.serverURL+basePath+"/signedUrl?jwt="+jwt, nil)
+	})
 	if err != nil {
-		return err
+		return fmt.Errorf("get file: %w", err)
 	}
 	defer resp.Body.Close()
 
 	// Check server response
 	if err := handleHTTPResponse(resp); err != nil {
-		return err
+		return fmt.Errorf("get file: %w", err)
 	}
 
 	// Writer the body to file
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return err
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("get file: write %s: %w", path, err)
 	}
 
 	return nil
@@ -306,22 +434,22 @@ type FileDetails struct {
 // GetFileDetails will download the file details from the files api.  This can then be parsed into
 // DownloadFile to download the file
 func (api *CacophonyAPI) GetFileDetails(fileID int) (*FileResponse, error) {
-	buf := new(bytes.Buffer)
-
-	req, err := http.NewRequest("GET", api.serverURL+basePath+"/files/"+strconv.Itoa(fileID), buf)
-	req.Header.Set("Authorization", api.Client.token)
-	//client := new(http.Client)
-
-	resp, err := api.httpClient.Do(req)
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", api.serverURL+basePath+"/files/"+strconv.Itoa(fileID), nil)
+	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get file details id=%d: %w", fileID, err)
 	}
 	defer resp.Body.Close()
 
+	if err := handleHTTPResponse(resp); err != nil {
+		return nil, fmt.Errorf("get file details id=%d: %w", fileID, err)
+	}
+
 	var fr FileResponse
 	d := json.NewDecoder(resp.Body)
 	if err := d.Decode(&fr); err != nil {
-		return &fr, err
+		return &fr, fmt.Errorf("get file details id=%d: decode: %w", fileID, err)
 	}
 	return &fr, nil
 }
@@ -329,18 +457,21 @@ func (api *CacophonyAPI) GetFileDetails(fileID int) (*FileResponse, error) {
 // DownloadFile will take the file details from GetFileDetails and download the file to a specified path
 func (api *CacophonyAPI) DownloadFile(fileResponse *FileResponse, filePath string) error {
 	if _, err := os.Stat(filePath); err == nil {
-		return err
+		// File already exists; nothing to do.
+		return nil
 	}
 
-	return api.getFileFromJWT(fileResponse.Jwt, filePath)
+	if err := api.getFileFromJWT(fileResponse.Jwt, filePath); err != nil {
+		return fmt.Errorf("download file %s: %w", filePath, err)
+	}
+	return nil
 }
 
 func (api *CacophonyAPI) ReportEvent(jsonDetails []byte, times []time.Time) error {
 	// Deserialise the JSON event details into a map.
 	var details map[string]interface{}
-	err := json.Unmarshal(jsonDetails, &details)
-	if err != nil {
-		return err
+	if err := json.Unmarshal(jsonDetails, &details); err != nil {
+		return fmt.Errorf("report event: unmarshal: %w", err)
 	}
 
 	// Convert the event times for sending and add to the map to send.
@@ -353,44 +484,52 @@ func (api *CacophonyAPI) ReportEvent(jsonDetails []byte, times []time.Time) erro
 	// Serialise the map back to JSON for sending.
 	jsonAll, err := json.Marshal(details)
 	if err != nil {
-		return err
-	}
-
-	// Prepare request.
-	req, err := http.NewRequest("POST", api.serverURL+basePath+"/events", bytes.NewReader(jsonAll))
-	if err != nil {
-		return err
+		return fmt.Errorf("report event: marshal: %w", err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", api.Client.token)
 
-	// Send.
-	//client := &http.Client{Timeout: httpTimeout}
-	resp, err := api.httpClient.Do(req)
+	// Send, wrapping the request so doRequest can rebuild it on retry.
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", api.serverURL+basePath+"/events", bytes.NewReader(jsonAll))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
-		return temporaryError(err)
+		return fmt.Errorf("report event: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if err := handleHTTPResponse(resp); err != nil {
-		return err
+		return fmt.Errorf("report event: %w", err)
 	}
 
 	return nil
 }
 
 func handleHTTPResponse(resp *http.Response) error {
-	if !(isHTTPSuccess(resp.StatusCode)) {
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return temporaryError(fmt.Errorf("request failed (%d) and body read failed: %v", resp.StatusCode, err))
-		}
-		return &Error{
-			message:   fmt.Sprintf("HTTP request failed (%d): %s", resp.StatusCode, body),
-			permanent: isHTTPClientError(resp.StatusCode),
-		}
+	if isHTTPSuccess(resp.StatusCode) {
+		return nil
 	}
-	return nil
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return temporaryError(fmt.Errorf("request failed (%d) and body read failed: %w", resp.StatusCode, err))
+	}
+
+	var cause error
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		cause = fmt.Errorf("%w (%d): %s", ErrAuthFailed, resp.StatusCode, body)
+	default:
+		cause = fmt.Errorf("request failed (%d): %s", resp.StatusCode, body)
+	}
+
+	if isHTTPClientError(resp.StatusCode) {
+		return permanentError(cause)
+	}
+	return temporaryError(cause)
 }
 
 func formatTimestamp(t time.Time) string {
@@ -407,15 +546,21 @@ func isHTTPClientError(code int) bool {
 
 // GetSchedule will get the audio schedule
 func (api *CacophonyAPI) GetSchedule() ([]byte, error) {
-	req, err := http.NewRequest("GET", api.serverURL+basePath+"schedules", nil)
-	req.Header.Set("Authorization", api.Client.token)
-	//client := new(http.Client)
-
-	resp, err := api.httpClient.Do(req)
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", api.serverURL+basePath+"schedules", nil)
+	})
 	if err != nil {
-		return []byte{}, err
+		return nil, fmt.Errorf("get schedule: %w", err)
 	}
 	defer resp.Body.Close()
 
-	return ioutil.ReadAll(resp.Body)
+	if err := handleHTTPResponse(resp); err != nil {
+		return nil, fmt.Errorf("get schedule: %w", err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("get schedule: read body: %w", err)
+	}
+	return body, nil
 }
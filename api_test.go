@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoRequestRetriesTransientErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 2 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if err != nil {
+		t.Fatalf("doRequest: %v", err)
+	}
+	resp.Body.Close()
+
+	if attempts != 2 {
+		t.Fatalf("got %d attempts, want 2", attempts)
+	}
+}
+
+func TestDoRequestGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL, nil)
+	})
+	if err != nil {
+		t.Fatalf("doRequest: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if attempts != maxRequestAttempts {
+		t.Fatalf("got %d attempts, want %d", attempts, maxRequestAttempts)
+	}
+	if err := handleHTTPResponse(resp); err == nil {
+		t.Fatal("handleHTTPResponse returned nil for an exhausted 5xx response")
+	}
+}
+
+func TestDoRequestReauthenticatesOn401(t *testing.T) {
+	var authCalls, dataCalls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authenticate_device", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&authCalls, 1)
+		json.NewEncoder(w).Encode(tokenResponse{Success: true, Token: "fresh-token"})
+	})
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&dataCalls, 1) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "fresh-token" {
+			t.Errorf("retried request Authorization = %q, want fresh-token", got)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL+"/data", nil)
+	})
+	if err != nil {
+		t.Fatalf("doRequest: %v", err)
+	}
+	resp.Body.Close()
+
+	if authCalls != 1 {
+		t.Fatalf("got %d authenticate calls, want 1", authCalls)
+	}
+	if dataCalls != 2 {
+		t.Fatalf("got %d data calls, want 2", dataCalls)
+	}
+}
+
+// TestDoRequestReauthenticateFailureKeepsErrorChain checks that when
+// re-authentication itself fails, the caller can still see why via
+// errors.Is all the way down to ErrAuthFailed, not just ErrTokenExpired.
+func TestDoRequestReauthenticateFailureKeepsErrorChain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authenticate_device", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	_, err := api.doRequest(func() (*http.Request, error) {
+		return http.NewRequest("GET", server.URL+"/data", nil)
+	})
+	if err == nil {
+		t.Fatal("doRequest returned nil, want an error")
+	}
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("error = %v, want errors.Is ErrTokenExpired", err)
+	}
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("error = %v, want errors.Is ErrAuthFailed (chain preserved through reauthenticate failure)", err)
+	}
+}
+
+// TestReauthenticateSerializesConcurrentCallers checks the concurrency
+// guarantee documented on reauthenticate: callers sharing one CacophonyAPI
+// never run authenticate() at the same time, they queue up behind refreshMu.
+func TestReauthenticateSerializesConcurrentCallers(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, overlapped bool
+	var calls int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if inFlight {
+			overlapped = true
+		}
+		inFlight = true
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+		n := atomic.AddInt32(&calls, 1)
+
+		mu.Lock()
+		inFlight = false
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(tokenResponse{Success: true, Token: fmt.Sprintf("token-%d", n)})
+	}))
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+
+	const callers = 10
+	var wg sync.WaitGroup
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if err := api.reauthenticate(); err != nil {
+				t.Errorf("reauthenticate: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if overlapped {
+		t.Fatal("authenticate ran concurrently; refreshMu did not serialize reauthenticate callers")
+	}
+	if calls != callers {
+		t.Fatalf("got %d authenticate calls, want %d", calls, callers)
+	}
+}
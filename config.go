@@ -19,11 +19,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
-	"time"
 
-	"github.com/gofrs/flock"
 	"github.com/spf13/afero"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -41,23 +38,41 @@ type Config struct {
 	Group      string `yaml:"group" json:"groupname"`
 	DeviceName string `yaml:"device-name" json:"devicename"`
 	filePath   string
+
+	// SecretStoreKind picks the SecretStore backend used to persist the
+	// PrivateConfig. Empty (or "file") keeps the default afero-backed
+	// store; "vault" needs the Vault block below, and "keyring" uses
+	// KeyringService ("cacophony-device" if empty).
+	SecretStoreKind string       `yaml:"secret-store,omitempty" json:"secretStore,omitempty"`
+	Vault           *VaultConfig `yaml:"vault,omitempty" json:"vault,omitempty"`
+	KeyringService  string       `yaml:"keyring-service,omitempty" json:"keyringService,omitempty"`
+
+	// TLS settings for talking to a private Cacophony server behind
+	// mutual TLS or pinned against a self-signed CA. All optional; an
+	// empty Config talks to the public server with the system roots, as
+	// before.
+	CACert             string   `yaml:"ca-cert,omitempty" json:"caCert,omitempty"`
+	ClientCert         string   `yaml:"client-cert,omitempty" json:"clientCert,omitempty"`
+	ClientKey          string   `yaml:"client-key,omitempty" json:"clientKey,omitempty"`
+	InsecureSkipVerify bool     `yaml:"insecure-skip-verify,omitempty" json:"insecureSkipVerify,omitempty"`
+	ServerPinSHA256    []string `yaml:"server-pin-sha256,omitempty" json:"serverPinSHA256,omitempty"`
 }
 
 func GetConfig(filePath string) (*Config, error) {
 	if exists, err := afero.Exists(Fs, filePath); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get config %s: %w", filePath, err)
 	} else if !exists {
-		return nil, notRegisteredError
+		return nil, fmt.Errorf("get config %s: %w", filePath, ErrNotRegistered)
 	}
 
 	conf := &Config{
 		filePath: filePath,
 	}
 	if err := conf.read(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get config %s: %w", filePath, err)
 	}
 	if err := conf.Validate(); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("get config %s: %w", filePath, err)
 	}
 	return conf, nil
 }
@@ -65,17 +80,23 @@ func GetConfig(filePath string) (*Config, error) {
 func (c *Config) read() error {
 	buf, err := afero.ReadFile(Fs, c.filePath)
 	if err != nil {
-		return err
+		return fmt.Errorf("read: %w", err)
+	}
+	if err := yaml.Unmarshal(buf, c); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
 	}
-	return yaml.Unmarshal(buf, c)
+	return nil
 }
 
 func (c *Config) write() error {
 	buf, err := yaml.Marshal(c)
 	if err != nil {
-		return err
+		return fmt.Errorf("marshal config: %w", err)
 	}
-	return afero.WriteFile(Fs, c.filePath, buf, 0644)
+	if err := afero.WriteFile(Fs, c.filePath, buf, 0644); err != nil {
+		return fmt.Errorf("write config %s: %w", c.filePath, err)
+	}
+	return nil
 }
 
 func (c *Config) exists() (bool, error) {
@@ -94,12 +115,12 @@ func updateConfNameAndGroup(newdevice string, newgroup string, filePath string)
 
 func updateHostnameFiles(hostname string) error {
 	if err := afero.WriteFile(Fs, hostnameFile, []byte(hostname), 0644); err != nil {
-		return err
+		return fmt.Errorf("update hostname files: write %s: %w", hostnameFile, err)
 	}
 
 	input, err := afero.ReadFile(Fs, hostsFile)
 	if err != nil {
-		return err
+		return fmt.Errorf("update hostname files: read %s: %w", hostsFile, err)
 	}
 
 	lines := strings.Split(string(input), "\n")
@@ -110,8 +131,10 @@ func updateHostnameFiles(hostname string) error {
 		}
 	}
 	output := strings.Join(lines, "\n")
-	return afero.WriteFile(Fs, hostsFile, []byte(output), 0644)
-
+	if err := afero.WriteFile(Fs, hostsFile, []byte(output), 0644); err != nil {
+		return fmt.Errorf("update hostname files: write %s: %w", hostsFile, err)
+	}
+	return nil
 }
 
 //Validate checks supplied Config contains the required data
@@ -136,87 +159,23 @@ func (conf *PrivateConfig) IsValid() bool {
 	return conf.Password != "" && conf.DeviceID != 0
 }
 
-const (
-	lockfile       = "/var/lock/go-api-priv.lock"
-	lockRetryDelay = 678 * time.Millisecond
-	lockTimeout    = 5 * time.Second
-)
-
-// LoadPrivateConfig acquires a readlock and reads private config
+// LoadPrivateConfig reads the private config using the SecretStore backend
+// named in device.yaml (the default afero-backed file store if none is
+// set).
 func LoadPrivateConfig() (*PrivateConfig, error) {
-	lockSafeConfig := NewLockSafeConfig(RegisteredConfigPath)
-	return lockSafeConfig.Read()
-}
-
-type LockSafeConfig struct {
-	fileLock *flock.Flock
-	filename string
-	config   *PrivateConfig
-}
-
-func NewLockSafeConfig(filename string) *LockSafeConfig {
-	return &LockSafeConfig{
-		filename: filename,
-		fileLock: flock.New(lockfile),
-	}
-}
-
-func (lockSafeConfig *LockSafeConfig) Unlock() {
-	lockSafeConfig.fileLock.Unlock()
-}
-
-// GetExLock acquires an exclusive lock on confPassword
-func (lockSafeConfig *LockSafeConfig) GetExLock() (bool, error) {
-	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
-	defer cancel()
-	locked, err := lockSafeConfig.fileLock.TryLockContext(lockCtx, lockRetryDelay)
-	return locked, err
-}
-
-// getReadLock  acquires a read lock on the supplied Flock struct
-func getReadLock(fileLock *flock.Flock) (bool, error) {
-	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
-	defer cancel()
-	locked, err := fileLock.TryRLockContext(lockCtx, lockRetryDelay)
-	return locked, err
-}
-
-// ReadPassword acquires a readlock and reads the config
-func (lockSafeConfig *LockSafeConfig) Read() (*PrivateConfig, error) {
-	locked := lockSafeConfig.fileLock.Locked()
-	if locked == false {
-		locked, err := getReadLock(lockSafeConfig.fileLock)
-		if locked == false || err != nil {
-			return nil, err
-		}
-		defer lockSafeConfig.Unlock()
-	}
-
-	buf, err := afero.ReadFile(Fs, lockSafeConfig.filename)
-	if os.IsNotExist(err) {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-	if err := yaml.Unmarshal(buf, &lockSafeConfig.config); err != nil {
-		return nil, err
+	conf, err := GetConfig(DeviceConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("load private config: %w", err)
 	}
-	return lockSafeConfig.config, nil
-}
-
-// WritePassword checks the file is locked and writes the password
-func (lockSafeConfig *LockSafeConfig) Write(deviceID int, password string) error {
-	conf := PrivateConfig{DeviceID: deviceID, Password: password}
-	buf, err := yaml.Marshal(&conf)
+	lockSafeConfig, err := NewLockSafeConfig(RegisteredConfigPath, SecretStoreKind(conf.SecretStoreKind), conf)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("load private config: %w", err)
 	}
-	if lockSafeConfig.fileLock.Locked() {
-		err = afero.WriteFile(Fs, lockSafeConfig.filename, buf, 0600)
-	} else {
-		return fmt.Errorf("file is not locked %v", lockSafeConfig.filename)
+	privConf, err := lockSafeConfig.Read(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("load private config: %w", err)
 	}
-	return err
+	return privConf, nil
 }
 
 var Fs = afero.NewOsFs()
@@ -0,0 +1,65 @@
+// go-api - Client for the Cacophony API server.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package api
+
+import "errors"
+
+// Sentinel errors so callers can tell "never registered" apart from "bad
+// credentials" apart from "network down" with errors.Is instead of
+// matching on error strings.
+var (
+	ErrNotRegistered = errors.New("device not registered")
+	ErrAuthFailed    = errors.New("authentication failed")
+	ErrTokenExpired  = errors.New("token expired")
+	ErrPermanent     = errors.New("permanent error")
+)
+
+// Error is returned by calls that failed to reach the API server or got a
+// non-success response from it. permanent marks responses that won't succeed on
+// retry (HTTP 4xx), as opposed to transient ones (5xx, network errors)
+// that might.
+type Error struct {
+	message   string
+	permanent bool
+	cause     error
+}
+
+func (e *Error) Error() string {
+	return e.message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is lets errors.Is(err, ErrPermanent) report whether err is a permanent
+// Error, without every caller needing to type-assert and check the
+// permanent field themselves.
+func (e *Error) Is(target error) bool {
+	return target == ErrPermanent && e.permanent
+}
+
+// temporaryError wraps err as a transient failure: network errors, 5xx
+// responses, anything worth retrying.
+func temporaryError(err error) error {
+	return &Error{message: err.Error(), permanent: false, cause: err}
+}
+
+// permanentError wraps err as a failure that won't succeed on retry, and
+// is discoverable via errors.Is(err, ErrPermanent).
+func permanentError(err error) error {
+	return &Error{message: err.Error(), permanent: true, cause: err}
+}
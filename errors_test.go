@@ -0,0 +1,88 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func testAPI(t *testing.T, serverURL string) *CacophonyAPI {
+	t.Helper()
+	return &CacophonyAPI{
+		Client:     &CacophonyClient{name: "test", password: "hunter2"},
+		httpClient: http.DefaultClient,
+		serverURL:  serverURL,
+		regURL:     serverURL + basePath + "/devices",
+		authURL:    serverURL + "/authenticate_device",
+	}
+}
+
+func TestHandleHTTPResponseErrors(t *testing.T) {
+	cases := []struct {
+		name          string
+		status        int
+		wantAuth      bool
+		wantPermanent bool
+	}{
+		{"unauthorized", http.StatusUnauthorized, true, true},
+		{"forbidden", http.StatusForbidden, true, true},
+		{"bad request", http.StatusBadRequest, false, true},
+		{"server error", http.StatusInternalServerError, false, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			resp, err := http.Get(server.URL)
+			if err != nil {
+				t.Fatalf("GET: %v", err)
+			}
+			defer resp.Body.Close()
+
+			err = handleHTTPResponse(resp)
+			if err == nil {
+				t.Fatalf("handleHTTPResponse returned nil, want an error")
+			}
+			if errors.Is(err, ErrAuthFailed) != tc.wantAuth {
+				t.Errorf("errors.Is(err, ErrAuthFailed) = %v, want %v", errors.Is(err, ErrAuthFailed), tc.wantAuth)
+			}
+			if errors.Is(err, ErrPermanent) != tc.wantPermanent {
+				t.Errorf("errors.Is(err, ErrPermanent) = %v, want %v", errors.Is(err, ErrPermanent), tc.wantPermanent)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWrapsErrAuthFailed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	err := api.authenticate()
+	if err == nil {
+		t.Fatal("authenticate returned nil, want an error")
+	}
+	if !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("authenticate error = %v, want errors.Is ErrAuthFailed", err)
+	}
+}
+
+func TestGetConfigWrapsErrNotRegistered(t *testing.T) {
+	origFs := Fs
+	Fs = afero.NewMemMapFs()
+	defer func() { Fs = origFs }()
+
+	_, err := GetConfig("/etc/cacophony/device.yaml")
+	if !errors.Is(err, ErrNotRegistered) {
+		t.Errorf("GetConfig error = %v, want errors.Is ErrNotRegistered", err)
+	}
+}
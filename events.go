@@ -0,0 +1,75 @@
+// go-api - Client for the Cacophony API server.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// EventBatchItem is a single event to send via ReportEvents. It carries
+// the same jsonDetails + times pair that ReportEvent takes.
+type EventBatchItem struct {
+	JSONDetails []byte
+	Times       []time.Time
+}
+
+// ReportEvents posts many events to the API server in a single /events
+// request, which is cheaper than one ReportEvent call per event when
+// catching up on a backlog (see EventSpool).
+func (api *CacophonyAPI) ReportEvents(items []EventBatchItem) error {
+	events := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		var details map[string]interface{}
+		if err := json.Unmarshal(item.JSONDetails, &details); err != nil {
+			return fmt.Errorf("report events: unmarshal: %w", err)
+		}
+
+		dateTimes := make([]string, 0, len(item.Times))
+		for _, t := range item.Times {
+			dateTimes = append(dateTimes, formatTimestamp(t))
+		}
+		details["dateTimes"] = dateTimes
+
+		events = append(events, details)
+	}
+
+	jsonAll, err := json.Marshal(events)
+	if err != nil {
+		return fmt.Errorf("report events: marshal: %w", err)
+	}
+
+	resp, err := api.doRequest(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", api.serverURL+basePath+"/events", bytes.NewReader(jsonAll))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("report events: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := handleHTTPResponse(resp); err != nil {
+		return fmt.Errorf("report events: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+// go-api - Client for the Cacophony API server.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofrs/flock"
+	vaultapi "github.com/hashicorp/vault/api"
+	"github.com/spf13/afero"
+	"github.com/zalando/go-keyring"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SecretStoreKind selects the SecretStore backend NewLockSafeConfig builds.
+type SecretStoreKind string
+
+const (
+	SecretStoreFile    SecretStoreKind = "file"
+	SecretStoreVault   SecretStoreKind = "vault"
+	SecretStoreKeyring SecretStoreKind = "keyring"
+)
+
+// SecretStore persists a device's PrivateConfig. Read/Write do the actual
+// storage; Lock/Unlock give callers mutual exclusion around a read-modify-
+// write, which matters most for the file backend where several
+// cacophony-project processes on the same device can race over the same
+// file.
+type SecretStore interface {
+	Read(ctx context.Context) (*PrivateConfig, error)
+	Write(ctx context.Context, conf *PrivateConfig) error
+	Lock(ctx context.Context) (bool, error)
+	Unlock() error
+}
+
+// VaultConfig configures the Vault KV v2 SecretStore backend. Auth is by
+// token if Token is set, otherwise by AppRole.
+type VaultConfig struct {
+	Address    string `yaml:"address" json:"address"`
+	Token      string `yaml:"token,omitempty" json:"token,omitempty"`
+	RoleID     string `yaml:"role-id,omitempty" json:"roleID,omitempty"`
+	SecretID   string `yaml:"secret-id,omitempty" json:"secretID,omitempty"`
+	MountPath  string `yaml:"mount-path,omitempty" json:"mountPath,omitempty"`
+	SecretPath string `yaml:"secret-path,omitempty" json:"secretPath,omitempty"`
+}
+
+// LockSafeConfig is a lock-guarded handle onto a device's PrivateConfig. It
+// delegates the actual storage to a SecretStore so callers keep working
+// with the same Read/Write/Lock/Unlock API regardless of backend.
+type LockSafeConfig struct {
+	store SecretStore
+}
+
+// NewLockSafeConfig builds a LockSafeConfig backed by kind. filename is
+// only used by SecretStoreFile; conf supplies the Vault/keyring settings
+// for the other backends (see Config.Vault, Config.KeyringService). An
+// empty kind defaults to SecretStoreFile so existing callers keep working
+// unchanged.
+func NewLockSafeConfig(filename string, kind SecretStoreKind, conf *Config) (*LockSafeConfig, error) {
+	switch kind {
+	case "", SecretStoreFile:
+		return &LockSafeConfig{store: newFileSecretStore(filename)}, nil
+	case SecretStoreVault:
+		if conf == nil || conf.Vault == nil {
+			return nil, errors.New("secret-store: vault selected but no vault config supplied")
+		}
+		store, err := newVaultSecretStore(conf.Vault)
+		if err != nil {
+			return nil, err
+		}
+		return &LockSafeConfig{store: store}, nil
+	case SecretStoreKeyring:
+		service := ""
+		if conf != nil {
+			service = conf.KeyringService
+		}
+		return &LockSafeConfig{store: newKeyringSecretStore(service)}, nil
+	default:
+		return nil, fmt.Errorf("secret-store: unknown backend %q", kind)
+	}
+}
+
+func (l *LockSafeConfig) Read(ctx context.Context) (*PrivateConfig, error) {
+	return l.store.Read(ctx)
+}
+
+func (l *LockSafeConfig) Write(ctx context.Context, conf *PrivateConfig) error {
+	return l.store.Write(ctx, conf)
+}
+
+// Lock acquires an exclusive lock ahead of a Write.
+func (l *LockSafeConfig) Lock(ctx context.Context) (bool, error) {
+	return l.store.Lock(ctx)
+}
+
+func (l *LockSafeConfig) Unlock() error {
+	return l.store.Unlock()
+}
+
+const (
+	lockfile       = "/var/lock/go-api-priv.lock"
+	lockRetryDelay = 678 * time.Millisecond
+	lockTimeout    = 5 * time.Second
+)
+
+// fileSecretStore is the default SecretStore: PrivateConfig as plaintext
+// YAML on disk, guarded by a flock so readers and writers across processes
+// don't race.
+type fileSecretStore struct {
+	fileLock *flock.Flock
+	filename string
+}
+
+func newFileSecretStore(filename string) *fileSecretStore {
+	return &fileSecretStore{
+		filename: filename,
+		fileLock: flock.New(lockfile),
+	}
+}
+
+func (s *fileSecretStore) Lock(ctx context.Context) (bool, error) {
+	lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+	return s.fileLock.TryLockContext(lockCtx, lockRetryDelay)
+}
+
+func (s *fileSecretStore) Unlock() error {
+	return s.fileLock.Unlock()
+}
+
+func (s *fileSecretStore) Read(ctx context.Context) (*PrivateConfig, error) {
+	locked := s.fileLock.Locked()
+	if !locked {
+		lockCtx, cancel := context.WithTimeout(ctx, lockTimeout)
+		defer cancel()
+		ok, err := s.fileLock.TryRLockContext(lockCtx, lockRetryDelay)
+		if err != nil {
+			return nil, fmt.Errorf("secret store read %s: lock: %w", s.filename, err)
+		}
+		if !ok {
+			return nil, fmt.Errorf("secret store read %s: lock: timed out", s.filename)
+		}
+		defer s.fileLock.Unlock()
+	}
+
+	buf, err := afero.ReadFile(Fs, s.filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("secret store read %s: %w", s.filename, err)
+	}
+	var conf PrivateConfig
+	if err := yaml.Unmarshal(buf, &conf); err != nil {
+		return nil, fmt.Errorf("secret store read %s: unmarshal: %w", s.filename, err)
+	}
+	return &conf, nil
+}
+
+func (s *fileSecretStore) Write(ctx context.Context, conf *PrivateConfig) error {
+	buf, err := yaml.Marshal(conf)
+	if err != nil {
+		return fmt.Errorf("secret store write %s: marshal: %w", s.filename, err)
+	}
+	if !s.fileLock.Locked() {
+		return fmt.Errorf("secret store write %s: file is not locked", s.filename)
+	}
+	if err := afero.WriteFile(Fs, s.filename, buf, 0600); err != nil {
+		return fmt.Errorf("secret store write %s: %w", s.filename, err)
+	}
+	return nil
+}
+
+// vaultSecretStore stores the PrivateConfig as a Vault KV v2 secret.
+type vaultSecretStore struct {
+	logical    vaultLogical
+	mountPath  string
+	secretPath string
+}
+
+// vaultLogical is the subset of *vaultapi.Logical this package uses,
+// narrowed so tests can supply an in-memory fake instead of a real server.
+type vaultLogical interface {
+	ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error)
+	WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error)
+}
+
+func newVaultSecretStore(conf *VaultConfig) (*vaultSecretStore, error) {
+	cfg := vaultapi.DefaultConfig()
+	cfg.Address = conf.Address
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("vault client: %w", err)
+	}
+
+	switch {
+	case conf.Token != "":
+		client.SetToken(conf.Token)
+	case conf.RoleID != "":
+		token, err := vaultApproleLogin(client.Logical(), conf.RoleID, conf.SecretID)
+		if err != nil {
+			return nil, fmt.Errorf("vault approle login: %w", err)
+		}
+		client.SetToken(token)
+	default:
+		return nil, errors.New("vault secret store needs either token or role-id/secret-id")
+	}
+
+	mountPath := conf.MountPath
+	if mountPath == "" {
+		mountPath = "secret"
+	}
+	secretPath := conf.SecretPath
+	if secretPath == "" {
+		secretPath = "cacophony/device"
+	}
+
+	return &vaultSecretStore{
+		logical:    client.Logical(),
+		mountPath:  mountPath,
+		secretPath: secretPath,
+	}, nil
+}
+
+func vaultApproleLogin(logical vaultLogical, roleID, secretID string) (string, error) {
+	secret, err := logical.WriteWithContext(context.Background(), "auth/approle/login", map[string]interface{}{
+		"role_id":   roleID,
+		"secret_id": secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Auth == nil {
+		return "", errors.New("no auth info returned from approle login")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// Lock is a no-op: Vault's KV v2 writes are already atomic server-side, and
+// coordinating several devices that happen to share a Vault secret isn't a
+// goal here.
+func (s *vaultSecretStore) Lock(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (s *vaultSecretStore) Unlock() error {
+	return nil
+}
+
+func (s *vaultSecretStore) dataPath() string {
+	return s.mountPath + "/data/" + s.secretPath
+}
+
+func (s *vaultSecretStore) Read(ctx context.Context) (*PrivateConfig, error) {
+	secret, err := s.logical.ReadWithContext(ctx, s.dataPath())
+	if err != nil {
+		return nil, fmt.Errorf("vault read %s: %w", s.dataPath(), err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, nil
+	}
+	data, _ := secret.Data["data"].(map[string]interface{})
+
+	conf := &PrivateConfig{}
+	if password, ok := data["password"].(string); ok {
+		conf.Password = password
+	}
+	switch deviceID := data["device-id"].(type) {
+	case json.Number:
+		id, err := deviceID.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("vault read %s: device-id: %w", s.dataPath(), err)
+		}
+		conf.DeviceID = int(id)
+	case float64:
+		conf.DeviceID = int(deviceID)
+	case int:
+		// A real Vault server round-trips device-id through JSON (json.Number
+		// or float64 depending on decoder settings); int only shows up here
+		// via a fake vaultLogical in tests that skips the JSON encoding.
+		conf.DeviceID = deviceID
+	}
+	return conf, nil
+}
+
+func (s *vaultSecretStore) Write(ctx context.Context, conf *PrivateConfig) error {
+	_, err := s.logical.WriteWithContext(ctx, s.dataPath(), map[string]interface{}{
+		"data": map[string]interface{}{
+			"password":  conf.Password,
+			"device-id": conf.DeviceID,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("vault write %s: %w", s.dataPath(), err)
+	}
+	return nil
+}
+
+// keyringSecretStore stores the PrivateConfig as a single JSON blob in the
+// OS keyring (Secret Service, Keychain, Credential Manager, ...).
+type keyringSecretStore struct {
+	service string
+}
+
+const keyringUser = "device-priv"
+
+func newKeyringSecretStore(service string) *keyringSecretStore {
+	if service == "" {
+		service = "cacophony-device"
+	}
+	return &keyringSecretStore{service: service}
+}
+
+// Lock is a no-op: OS keyrings don't expose cross-process locking, and a
+// single device only ever has one agent managing its PrivateConfig.
+func (s *keyringSecretStore) Lock(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (s *keyringSecretStore) Unlock() error {
+	return nil
+}
+
+func (s *keyringSecretStore) Read(ctx context.Context) (*PrivateConfig, error) {
+	raw, err := keyring.Get(s.service, keyringUser)
+	if err == keyring.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("keyring get %s: %w", s.service, err)
+	}
+	var conf PrivateConfig
+	if err := json.Unmarshal([]byte(raw), &conf); err != nil {
+		return nil, fmt.Errorf("keyring get %s: %w", s.service, err)
+	}
+	return &conf, nil
+}
+
+func (s *keyringSecretStore) Write(ctx context.Context, conf *PrivateConfig) error {
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	if err := keyring.Set(s.service, keyringUser, string(raw)); err != nil {
+		return fmt.Errorf("keyring set %s: %w", s.service, err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// fakeVaultLogical is an in-memory stand-in for *vaultapi.Logical, keyed by
+// path, that's enough for vaultSecretStore's KV v2 Read/Write round trip.
+type fakeVaultLogical struct {
+	data map[string]map[string]interface{}
+}
+
+func newFakeVaultLogical() *fakeVaultLogical {
+	return &fakeVaultLogical{data: make(map[string]map[string]interface{})}
+}
+
+func (f *fakeVaultLogical) ReadWithContext(ctx context.Context, path string) (*vaultapi.Secret, error) {
+	data, ok := f.data[path]
+	if !ok {
+		return nil, nil
+	}
+	return &vaultapi.Secret{Data: map[string]interface{}{"data": data}}, nil
+}
+
+func (f *fakeVaultLogical) WriteWithContext(ctx context.Context, path string, data map[string]interface{}) (*vaultapi.Secret, error) {
+	inner, _ := data["data"].(map[string]interface{})
+	f.data[path] = inner
+	return nil, nil
+}
+
+func TestVaultSecretStoreRoundTrip(t *testing.T) {
+	store := &vaultSecretStore{
+		logical:    newFakeVaultLogical(),
+		mountPath:  "secret",
+		secretPath: "cacophony/device",
+	}
+
+	want := &PrivateConfig{Password: "hunter2", DeviceID: 42}
+	if err := store.Write(context.Background(), want); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	got, err := store.Read(context.Background())
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got == nil || got.Password != want.Password || got.DeviceID != want.DeviceID {
+		t.Fatalf("Read returned %+v, want %+v", got, want)
+	}
+}
+
+func TestVaultSecretStoreReadMissing(t *testing.T) {
+	store := &vaultSecretStore{
+		logical:    newFakeVaultLogical(),
+		mountPath:  "secret",
+		secretPath: "cacophony/device",
+	}
+
+	got, err := store.Read(context.Background())
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if got != nil {
+		t.Fatalf("Read on empty store = %+v, want nil", got)
+	}
+}
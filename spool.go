@@ -0,0 +1,247 @@
+// go-api - Client for the Cacophony API server.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	deadSubdir = "dead"
+
+	// spoolMaxAge and spoolMaxFiles bound how much undelivered data an
+	// offline device accumulates; once over either limit, the oldest
+	// spooled events are dropped to make room for new ones.
+	spoolMaxAge   = 7 * 24 * time.Hour
+	spoolMaxFiles = 10000
+
+	spoolFlushInterval = 30 * time.Second
+)
+
+// spooledEvent is the on-disk record for one not-yet-delivered event.
+type spooledEvent struct {
+	JSONDetails json.RawMessage `json:"jsonDetails"`
+	Times       []time.Time     `json:"times"`
+}
+
+// EventSpool durably queues ReportEvent calls made while a device is
+// offline, under one file per event in dir, and flushes them to the API
+// server in batches once connectivity returns.
+type EventSpool struct {
+	dir string
+	api *CacophonyAPI
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewEventSpool returns an EventSpool that writes events under dir and
+// flushes them through apiClient. Call Start to begin the background
+// flush loop.
+func NewEventSpool(dir string, apiClient *CacophonyAPI) *EventSpool {
+	return &EventSpool{dir: dir, api: apiClient}
+}
+
+// Enqueue durably records an event for later delivery. It's a drop-in
+// replacement for CacophonyAPI.ReportEvent: same signature, but it doesn't
+// fail just because the device is offline right now.
+func (s *EventSpool) Enqueue(jsonDetails []byte, times []time.Time) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("event spool: %w", err)
+	}
+
+	buf, err := json.Marshal(spooledEvent{JSONDetails: jsonDetails, Times: times})
+	if err != nil {
+		return fmt.Errorf("event spool: marshal: %w", err)
+	}
+
+	name := s.nextName()
+	tmpPath := filepath.Join(s.dir, name+".tmp")
+	finalPath := filepath.Join(s.dir, name)
+
+	if err := writeFileSync(tmpPath, buf); err != nil {
+		return fmt.Errorf("event spool: %w", err)
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return fmt.Errorf("event spool: rename %s: %w", tmpPath, err)
+	}
+
+	s.evict()
+	return nil
+}
+
+func writeFileSync(path string, buf []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("create %s: %w", path, err)
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("fsync %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+func (s *EventSpool) nextName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	return fmt.Sprintf("%020d-%d", time.Now().UnixNano(), s.seq)
+}
+
+// spooledFiles returns the pending (not dead, not .tmp) spool files,
+// oldest first. Filenames are zero-padded nanosecond timestamps, so a
+// name sort is a time sort.
+func (s *EventSpool) spooledFiles() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("event spool: read dir %s: %w", s.dir, err)
+	}
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		files = append(files, e)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// evict drops the oldest spooled events once the spool is over age or
+// count, so a device that's offline for a long time doesn't fill its
+// disk.
+func (s *EventSpool) evict() {
+	files, err := s.spooledFiles()
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().Add(-spoolMaxAge)
+	for i, f := range files {
+		if i < len(files)-spoolMaxFiles || f.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(s.dir, f.Name()))
+		}
+	}
+}
+
+// Start launches the background worker that periodically flushes spooled
+// events until ctx is canceled.
+func (s *EventSpool) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(spoolFlushInterval)
+		defer ticker.Stop()
+		for {
+			s.flush()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// flush sends every currently spooled event to the API server in one
+// batched ReportEvents call. Delivered events are deleted; if the server
+// rejects the batch as a whole with a permanent (4xx) error, flush falls
+// back to resending the events one at a time so only the one(s) actually
+// at fault are moved to dead/ for inspection - the rest are delivered (or
+// left spooled) same as if they'd never shared a batch with a bad event.
+// Anything else (network down, 5xx) is left for the next tick.
+func (s *EventSpool) flush() {
+	files, err := s.spooledFiles()
+	if err != nil || len(files) == 0 {
+		return
+	}
+
+	items := make([]EventBatchItem, 0, len(files))
+	paths := make([]string, 0, len(files))
+	for _, f := range files {
+		path := filepath.Join(s.dir, f.Name())
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var ev spooledEvent
+		if err := json.Unmarshal(buf, &ev); err != nil {
+			s.moveToDead(path)
+			continue
+		}
+		items = append(items, EventBatchItem{JSONDetails: ev.JSONDetails, Times: ev.Times})
+		paths = append(paths, path)
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	if err := s.api.ReportEvents(items); err != nil {
+		if errors.Is(err, ErrPermanent) {
+			// The server rejected the batch as a whole, but not every event
+			// in it is necessarily bad - retry one at a time so only the
+			// event(s) that actually 4xx get dead-lettered, and anything
+			// that was fine alongside them still gets delivered.
+			s.flushOneByOne(items, paths)
+			return
+		}
+		// Otherwise it's a temporary error (network down, 5xx): leave the
+		// files spooled for the next tick.
+		return
+	}
+
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// flushOneByOne re-sends items individually after a batched ReportEvents
+// call came back with a permanent error, so a single bad event only
+// dead-letters itself instead of every event that happened to share its
+// batch.
+func (s *EventSpool) flushOneByOne(items []EventBatchItem, paths []string) {
+	for i, item := range items {
+		if err := s.api.ReportEvents([]EventBatchItem{item}); err != nil {
+			if errors.Is(err, ErrPermanent) {
+				s.moveToDead(paths[i])
+			}
+			// Temporary error: leave this one spooled for the next tick.
+			continue
+		}
+		os.Remove(paths[i])
+	}
+}
+
+func (s *EventSpool) moveToDead(path string) {
+	deadDir := filepath.Join(s.dir, deadSubdir)
+	if err := os.MkdirAll(deadDir, 0755); err != nil {
+		return
+	}
+	os.Rename(path, filepath.Join(deadDir, filepath.Base(path)))
+}
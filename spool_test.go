@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func enqueueTestEvent(t *testing.T, s *EventSpool, key string) {
+	t.Helper()
+	details, err := json.Marshal(map[string]string{"key": key})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if err := s.Enqueue(details, []time.Time{time.Now()}); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+}
+
+func TestEventSpoolFlushBatchesAndDeletesOnSuccess(t *testing.T) {
+	var requests int32
+	var batchSize int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		buf, _ := ioutil.ReadAll(r.Body)
+		var events []map[string]interface{}
+		if err := json.Unmarshal(buf, &events); err != nil {
+			t.Fatalf("decode posted events: %v", err)
+		}
+		batchSize = len(events)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	api := testAPI(t, server.URL)
+	s := NewEventSpool(dir, api)
+
+	enqueueTestEvent(t, s, "one")
+	enqueueTestEvent(t, s, "two")
+	enqueueTestEvent(t, s, "three")
+
+	s.flush()
+
+	if requests != 1 {
+		t.Fatalf("got %d ReportEvents requests, want 1 (batched)", requests)
+	}
+	if batchSize != 3 {
+		t.Fatalf("batch carried %d events, want 3", batchSize)
+	}
+
+	files, err := s.spooledFiles()
+	if err != nil {
+		t.Fatalf("spooledFiles: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("got %d spooled files after successful flush, want 0", len(files))
+	}
+}
+
+func TestEventSpoolFlushMovesPermanentErrorsToDead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	api := testAPI(t, server.URL)
+	s := NewEventSpool(dir, api)
+	enqueueTestEvent(t, s, "bad")
+
+	s.flush()
+
+	files, err := s.spooledFiles()
+	if err != nil {
+		t.Fatalf("spooledFiles: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("got %d files still spooled after a permanent error, want 0", len(files))
+	}
+
+	deadEntries, err := ioutil.ReadDir(filepath.Join(dir, deadSubdir))
+	if err != nil {
+		t.Fatalf("read dead dir: %v", err)
+	}
+	if len(deadEntries) != 1 {
+		t.Fatalf("got %d files in dead/, want 1", len(deadEntries))
+	}
+}
+
+func TestEventSpoolFlushLeavesFilesOnTemporaryError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	api := testAPI(t, server.URL)
+	s := NewEventSpool(dir, api)
+	enqueueTestEvent(t, s, "retry-me")
+
+	s.flush()
+
+	files, err := s.spooledFiles()
+	if err != nil {
+		t.Fatalf("spooledFiles: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files after a temporary error, want 1 (left for next tick)", len(files))
+	}
+}
+
+func TestEventSpoolFlushRetriesOneByOneOnPermanentError(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		buf, _ := ioutil.ReadAll(r.Body)
+		var events []map[string]interface{}
+		if err := json.Unmarshal(buf, &events); err != nil {
+			t.Fatalf("decode posted events: %v", err)
+		}
+		for _, ev := range events {
+			if ev["key"] == "bad" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	api := testAPI(t, server.URL)
+	s := NewEventSpool(dir, api)
+
+	enqueueTestEvent(t, s, "good-one")
+	enqueueTestEvent(t, s, "bad")
+	enqueueTestEvent(t, s, "good-two")
+
+	s.flush()
+
+	if requests != 4 {
+		t.Fatalf("got %d ReportEvents requests, want 4 (1 batch + 3 individual retries)", requests)
+	}
+
+	files, err := s.spooledFiles()
+	if err != nil {
+		t.Fatalf("spooledFiles: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("got %d files still spooled, want 0 (the good ones should have been delivered)", len(files))
+	}
+
+	deadEntries, err := ioutil.ReadDir(filepath.Join(dir, deadSubdir))
+	if err != nil {
+		t.Fatalf("read dead dir: %v", err)
+	}
+	if len(deadEntries) != 1 {
+		t.Fatalf("got %d files in dead/, want 1 (only the bad event)", len(deadEntries))
+	}
+}
+
+func TestEventSpoolEvictsOldFiles(t *testing.T) {
+	dir := t.TempDir()
+	s := NewEventSpool(dir, nil)
+	enqueueTestEvent(t, s, "stale")
+
+	files, err := s.spooledFiles()
+	if err != nil || len(files) != 1 {
+		t.Fatalf("spooledFiles = %v, %v, want exactly 1 file", files, err)
+	}
+
+	old := time.Now().Add(-spoolMaxAge - time.Hour)
+	path := filepath.Join(dir, files[0].Name())
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	s.evict()
+
+	files, err = s.spooledFiles()
+	if err != nil {
+		t.Fatalf("spooledFiles: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("got %d files after evict, want 0 (past spoolMaxAge)", len(files))
+	}
+}
@@ -0,0 +1,147 @@
+// go-api - Client for the Cacophony API server.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package api
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// buildTLSConfig turns the TLS fields on Config into a *tls.Config: the
+// system roots, or only the ca-cert CA when one is set, an optional client
+// keypair for mTLS, and optional SPKI pinning.
+func buildTLSConfig(conf *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+
+	if conf.CACert != "" {
+		caPEM, err := afero.ReadFile(Fs, conf.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("read ca-cert %s: %w", conf.CACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("ca-cert %s: no certificates found", conf.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conf.ClientCert != "" || conf.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCert, conf.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("load client keypair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(conf.ServerPinSHA256) > 0 {
+		pins := make(map[string]bool, len(conf.ServerPinSHA256))
+		for _, pin := range conf.ServerPinSHA256 {
+			pins[pin] = true
+		}
+		tlsConfig.VerifyPeerCertificate = verifySPKIPin(pins)
+	}
+
+	return tlsConfig, nil
+}
+
+// verifySPKIPin returns a VerifyPeerCertificate callback that accepts the
+// connection only if one of the presented certificates' subject public key
+// matches a pinned base64-encoded SHA-256 hash. Pinning the public key
+// rather than the whole certificate means the pin survives routine
+// certificate renewal.
+func verifySPKIPin(pins map[string]bool) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+				return nil
+			}
+		}
+		return errors.New("server certificate does not match any pinned server-pin-sha256")
+	}
+}
+
+// tlsReloader holds the *tls.Config currently in use by newHTTPClient and
+// rebuilds it from conf whenever the process gets SIGHUP, so a
+// long-running device can pick up a renewed cert/key pair without
+// restarting.
+type tlsReloader struct {
+	conf    *Config
+	current atomic.Value // *tls.Config
+
+	sigCh    chan os.Signal
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTLSReloader(conf *Config) (*tlsReloader, error) {
+	tlsConfig, err := buildTLSConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	r := &tlsReloader{conf: conf, done: make(chan struct{})}
+	r.current.Store(tlsConfig)
+	return r, nil
+}
+
+func (r *tlsReloader) get() *tls.Config {
+	return r.current.Load().(*tls.Config)
+}
+
+// watchSIGHUP rebuilds the TLS config on every SIGHUP until stop is
+// called. Failed rebuilds (e.g. a cert file mid-write) are dropped,
+// leaving the previous, still valid config in place.
+func (r *tlsReloader) watchSIGHUP() {
+	r.sigCh = make(chan os.Signal, 1)
+	signal.Notify(r.sigCh, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-r.done:
+				signal.Stop(r.sigCh)
+				return
+			case <-r.sigCh:
+				if tlsConfig, err := buildTLSConfig(r.conf); err == nil {
+					r.current.Store(tlsConfig)
+				}
+			}
+		}
+	}()
+}
+
+// stop ends the SIGHUP-watching goroutine and unregisters its signal
+// channel. Safe to call even if watchSIGHUP was never called, and safe to
+// call more than once.
+func (r *tlsReloader) stop() {
+	r.stopOnce.Do(func() {
+		close(r.done)
+	})
+}
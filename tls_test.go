@@ -0,0 +1,157 @@
+package api
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// generateSelfSignedCert returns a PEM-encoded self-signed cert/key pair
+// and the parsed certificate, for exercising buildTLSConfig/verifySPKIPin
+// without a real CA.
+func generateSelfSignedCert(t *testing.T) (certPEM, keyPEM []byte, cert *x509.Certificate) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test-device"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, cert
+}
+
+func TestBuildTLSConfigLoadsCACert(t *testing.T) {
+	origFs := Fs
+	Fs = afero.NewMemMapFs()
+	defer func() { Fs = origFs }()
+
+	certPEM, _, _ := generateSelfSignedCert(t)
+	if err := afero.WriteFile(Fs, "/ca.pem", certPEM, 0644); err != nil {
+		t.Fatalf("write ca.pem: %v", err)
+	}
+
+	tlsConfig, err := buildTLSConfig(&Config{CACert: "/ca.pem"})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if tlsConfig.RootCAs == nil {
+		t.Fatal("RootCAs not set from ca-cert")
+	}
+}
+
+func TestBuildTLSConfigRejectsBadCACert(t *testing.T) {
+	origFs := Fs
+	Fs = afero.NewMemMapFs()
+	defer func() { Fs = origFs }()
+
+	if err := afero.WriteFile(Fs, "/ca.pem", []byte("not a cert"), 0644); err != nil {
+		t.Fatalf("write ca.pem: %v", err)
+	}
+
+	if _, err := buildTLSConfig(&Config{CACert: "/ca.pem"}); err == nil {
+		t.Fatal("buildTLSConfig with garbage ca-cert returned nil error")
+	}
+}
+
+func TestBuildTLSConfigLoadsClientKeypair(t *testing.T) {
+	certPEM, keyPEM, _ := generateSelfSignedCert(t)
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "client.pem")
+	keyPath := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("write client cert: %v", err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("write client key: %v", err)
+	}
+
+	tlsConfig, err := buildTLSConfig(&Config{ClientCert: certPath, ClientKey: keyPath})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if len(tlsConfig.Certificates) != 1 {
+		t.Fatalf("got %d certificates, want 1", len(tlsConfig.Certificates))
+	}
+}
+
+func TestBuildTLSConfigInsecureSkipVerify(t *testing.T) {
+	tlsConfig, err := buildTLSConfig(&Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("buildTLSConfig: %v", err)
+	}
+	if !tlsConfig.InsecureSkipVerify {
+		t.Error("InsecureSkipVerify not propagated from Config")
+	}
+}
+
+func TestVerifySPKIPin(t *testing.T) {
+	_, _, cert := generateSelfSignedCert(t)
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	t.Run("matching pin accepted", func(t *testing.T) {
+		verify := verifySPKIPin(map[string]bool{pin: true})
+		if err := verify([][]byte{cert.Raw}, nil); err != nil {
+			t.Errorf("verify with matching pin = %v, want nil", err)
+		}
+	})
+
+	t.Run("non-matching pin rejected", func(t *testing.T) {
+		verify := verifySPKIPin(map[string]bool{"not-the-real-pin": true})
+		if err := verify([][]byte{cert.Raw}, nil); err == nil {
+			t.Error("verify with non-matching pin = nil, want an error")
+		}
+	})
+}
+
+func TestTLSReloaderStopIsIdempotent(t *testing.T) {
+	r, err := newTLSReloader(&Config{})
+	if err != nil {
+		t.Fatalf("newTLSReloader: %v", err)
+	}
+	r.watchSIGHUP()
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			t.Fatalf("stop panicked on repeated calls: %v", recovered)
+		}
+	}()
+	r.stop()
+	r.stop()
+}
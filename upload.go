@@ -0,0 +1,275 @@
+// go-api - Client for the Cacophony API server.
+// Copyright (C) 2018, The Cacophony Project
+//
+//Licensed under the Apache License, Version 2.0 (the "License");
+//you may not use this file except in compliance with the License.
+//You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+//Unless required by applicable law or agreed to in writing, software
+//distributed under the License is distributed on an "AS IS" BASIS,
+//WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//See the License for the specific language governing permissions and
+//limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gofrs/flock"
+	"github.com/spf13/afero"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// UploadMeta is the "data" field sent alongside a streamed recording
+// upload.
+type UploadMeta struct {
+	Type string `json:"type"`
+}
+
+// UploadState is the uploadID plus last-acked offset persisted between
+// UploadThermalRawStream and a later ResumeUpload, so a crash mid-upload
+// can pick back up on restart instead of starting over. LoadUploadState
+// reads it back; ClearUploadState removes it once the caller has
+// confirmed the recording is fully delivered.
+type UploadState struct {
+	UploadID string `yaml:"upload-id"`
+	Offset   int64  `yaml:"offset"`
+}
+
+// uploadStateLockfile and uploadStatePath mirror lockfile/lockTimeout/
+// lockRetryDelay in secretstore.go: resumable uploads need the same
+// cross-process guard as PrivateConfig, just on a different file.
+const (
+	uploadStateLockfile = "/var/lock/go-api-upload.lock"
+	uploadStatePath     = "/etc/cacophony/device-upload.yaml"
+)
+
+// LoadUploadState reads back the uploadID/offset persisted by
+// UploadThermalRawStream or ResumeUpload, so a process that crashed
+// mid-upload can discover what it was in the middle of on restart and
+// call ResumeUpload(ctx, state.UploadID, r, state.Offset) to pick it back
+// up. Returns nil, nil if nothing is persisted.
+func LoadUploadState() (*UploadState, error) {
+	return readUploadState(uploadStatePath)
+}
+
+// ClearUploadState removes the persisted upload state. ResumeUpload already
+// does this itself after a successful PATCH; the state written by a
+// successful UploadThermalRawStream stays until a caller clears it here.
+func ClearUploadState() error {
+	return clearUploadState(uploadStatePath)
+}
+
+func readUploadState(path string) (*UploadState, error) {
+	fileLock := flock.New(uploadStateLockfile)
+	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	locked, err := fileLock.TryRLockContext(lockCtx, lockRetryDelay)
+	if err != nil {
+		return nil, fmt.Errorf("read upload state: lock: %w", err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("read upload state: lock: timed out")
+	}
+	defer fileLock.Unlock()
+
+	buf, err := afero.ReadFile(Fs, path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read upload state: %w", err)
+	}
+	var state UploadState
+	if err := yaml.Unmarshal(buf, &state); err != nil {
+		return nil, fmt.Errorf("read upload state: unmarshal: %w", err)
+	}
+	return &state, nil
+}
+
+func writeUploadState(path string, state *UploadState) error {
+	fileLock := flock.New(uploadStateLockfile)
+	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	locked, err := fileLock.TryLockContext(lockCtx, lockRetryDelay)
+	if err != nil {
+		return fmt.Errorf("write upload state: lock: %w", err)
+	}
+	if !locked {
+		return fmt.Errorf("write upload state: lock: timed out")
+	}
+	defer fileLock.Unlock()
+
+	buf, err := yaml.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("write upload state: %w", err)
+	}
+	if err := afero.WriteFile(Fs, path, buf, 0600); err != nil {
+		return fmt.Errorf("write upload state: %w", err)
+	}
+	return nil
+}
+
+func clearUploadState(path string) error {
+	fileLock := flock.New(uploadStateLockfile)
+	lockCtx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	locked, err := fileLock.TryLockContext(lockCtx, lockRetryDelay)
+	if err != nil {
+		return fmt.Errorf("clear upload state: lock: %w", err)
+	}
+	if !locked {
+		return fmt.Errorf("clear upload state: lock: timed out")
+	}
+	defer fileLock.Unlock()
+
+	if err := Fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("clear upload state: %w", err)
+	}
+	return nil
+}
+
+// UploadThermalRawStream streams r straight into the upload request body
+// via io.Pipe + multipart.Writer instead of buffering the whole recording
+// in memory first, which matters for multi-gigabyte raw thermal captures
+// on memory-constrained field devices. The uploadID comes from the server's
+// response, so it is returned and persisted (with offset 0) only once the
+// whole request has been accepted; a send that fails partway returns an
+// error with no uploadID and persists nothing for ResumeUpload to pick up.
+// Because r isn't guaranteed to be re-readable, a failed send here isn't
+// retried the way doRequest retries other calls.
+func (api *CacophonyAPI) UploadThermalRawStream(ctx context.Context, r io.Reader, meta UploadMeta) (string, error) {
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+
+	go func() {
+		dataBuf, err := json.Marshal(meta)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := w.WriteField("data", string(dataBuf)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		fw, err := w.CreateFormFile("file", "file")
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(fw, r); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", api.serverURL+basePath+"/recordings", pr)
+	if err != nil {
+		return "", fmt.Errorf("upload thermal raw stream: %w", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Authorization", api.Client.getToken())
+
+	resp, err := api.httpClient.Do(req)
+	if err != nil {
+		return "", temporaryError(fmt.Errorf("upload thermal raw stream: %w", err))
+	}
+	defer resp.Body.Close()
+
+	if err := handleHTTPResponse(resp); err != nil {
+		return "", fmt.Errorf("upload thermal raw stream: %w", err)
+	}
+
+	var created struct {
+		UploadID string `json:"uploadId"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", fmt.Errorf("upload thermal raw stream: decode upload response: %w", err)
+	}
+
+	if err := writeUploadState(uploadStatePath, &UploadState{UploadID: created.UploadID}); err != nil {
+		return created.UploadID, fmt.Errorf("upload thermal raw stream: %w", err)
+	}
+
+	return created.UploadID, nil
+}
+
+// ResumeUpload continues a transfer started by UploadThermalRawStream
+// after a crash or dropped connection, using the tus.io resumable upload
+// protocol: a HEAD request against uploadID tells the server how many
+// bytes it already has, then a single PATCH appends the rest starting at
+// that offset. offset is the caller's own record of how far it got; the
+// server's Upload-Offset wins if it's further along. Both requests go
+// through doRequest like every other call in this package, so a token
+// that expires mid-transfer gets re-authenticated and retried instead of
+// failing the resume outright; r is an io.ReaderAt specifically so the
+// PATCH body can be rebuilt fresh from offset on each retry attempt.
+func (api *CacophonyAPI) ResumeUpload(ctx context.Context, uploadID string, r io.ReaderAt, offset int64) error {
+	tusURL := api.serverURL + basePath + "/recordings/tus/" + uploadID
+
+	headResp, err := api.doRequest(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", tusURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("resume upload %s: %w", uploadID, err)
+	}
+	defer headResp.Body.Close()
+	if err := handleHTTPResponse(headResp); err != nil {
+		return fmt.Errorf("resume upload %s: %w", uploadID, err)
+	}
+
+	if serverOffset, err := strconv.ParseInt(headResp.Header.Get("Upload-Offset"), 10, 64); err == nil && serverOffset > offset {
+		offset = serverOffset
+	}
+	// Persist the server-acked offset before sending any more data, so a
+	// crash during the PATCH below still leaves behind the right place to
+	// resume from rather than the caller's possibly-stale offset.
+	if err := writeUploadState(uploadStatePath, &UploadState{UploadID: uploadID, Offset: offset}); err != nil {
+		return fmt.Errorf("resume upload %s: %w", uploadID, err)
+	}
+
+	patchResp, err := api.doRequest(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "PATCH", tusURL, io.NewSectionReader(r, offset, 1<<62))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+		return req, nil
+	})
+	if err != nil {
+		return fmt.Errorf("resume upload %s: %w", uploadID, err)
+	}
+	defer patchResp.Body.Close()
+	if err := handleHTTPResponse(patchResp); err != nil {
+		return fmt.Errorf("resume upload %s: %w", uploadID, err)
+	}
+
+	if _, err := strconv.ParseInt(patchResp.Header.Get("Upload-Offset"), 10, 64); err != nil {
+		return fmt.Errorf("resume upload %s: parse Upload-Offset: %w", uploadID, err)
+	}
+	// A successful PATCH here always sends every remaining byte in one
+	// shot (see io.NewSectionReader above), so reaching this point means
+	// the recording is fully delivered - nothing left to resume.
+	if err := clearUploadState(uploadStatePath); err != nil {
+		return fmt.Errorf("resume upload %s: %w", uploadID, err)
+	}
+
+	return nil
+}
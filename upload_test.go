@@ -0,0 +1,178 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestUploadThermalRawStream(t *testing.T) {
+	origFs := Fs
+	Fs = afero.NewMemMapFs()
+	defer func() { Fs = origFs }()
+
+	const wantContent = "some thermal raw bytes"
+	var gotType, gotContent string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/recordings", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Authorization"); got != "hunter2-token" {
+			t.Errorf("Authorization = %q, want hunter2-token", got)
+		}
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("parse content type: %v", err)
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			buf, _ := ioutil.ReadAll(part)
+			switch part.FormName() {
+			case "data":
+				var meta UploadMeta
+				json.Unmarshal(buf, &meta)
+				gotType = meta.Type
+			case "file":
+				gotContent = string(buf)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]string{"uploadId": "upload-123"})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	api.Client.setToken("hunter2-token")
+
+	uploadID, err := api.UploadThermalRawStream(context.Background(), strings.NewReader(wantContent), UploadMeta{Type: "thermalRaw"})
+	if err != nil {
+		t.Fatalf("UploadThermalRawStream: %v", err)
+	}
+	if uploadID != "upload-123" {
+		t.Errorf("uploadID = %q, want upload-123", uploadID)
+	}
+	if gotType != "thermalRaw" {
+		t.Errorf("server saw data type %q, want thermalRaw", gotType)
+	}
+	if gotContent != wantContent {
+		t.Errorf("server saw file content %q, want %q", gotContent, wantContent)
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	origFs := Fs
+	Fs = afero.NewMemMapFs()
+	defer func() { Fs = origFs }()
+
+	const fullContent = "0123456789"
+	const serverOffset = 4 // server already has bytes [0:4)
+	var gotPatchBody string
+	var gotUploadOffsetHeader string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/recordings/tus/upload-123", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Upload-Offset", "4")
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPatch:
+			gotUploadOffsetHeader = r.Header.Get("Upload-Offset")
+			buf, _ := ioutil.ReadAll(r.Body)
+			gotPatchBody = string(buf)
+			w.Header().Set("Upload-Offset", "10")
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Fatalf("unexpected method %s", r.Method)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	api.Client.setToken("hunter2-token")
+
+	// Caller's own record says offset 0; the server's HEAD response (4)
+	// should win and only the unsent remainder should be PATCHed.
+	r := bytes.NewReader([]byte(fullContent))
+	if err := api.ResumeUpload(context.Background(), "upload-123", r, 0); err != nil {
+		t.Fatalf("ResumeUpload: %v", err)
+	}
+
+	if gotUploadOffsetHeader != "4" {
+		t.Errorf("PATCH Upload-Offset header = %q, want 4", gotUploadOffsetHeader)
+	}
+	if gotPatchBody != fullContent[serverOffset:] {
+		t.Errorf("PATCH body = %q, want %q", gotPatchBody, fullContent[serverOffset:])
+	}
+
+	state, err := LoadUploadState()
+	if err != nil {
+		t.Fatalf("LoadUploadState: %v", err)
+	}
+	if state != nil {
+		t.Errorf("LoadUploadState = %+v, want nil after a fully-delivered ResumeUpload", state)
+	}
+}
+
+// TestResumeUploadReauthenticatesOn401 checks that ResumeUpload goes
+// through doRequest like every other request in this package, so a token
+// that expires mid-transfer gets re-authenticated and retried instead of
+// failing the resume outright.
+func TestResumeUploadReauthenticatesOn401(t *testing.T) {
+	origFs := Fs
+	Fs = afero.NewMemMapFs()
+	defer func() { Fs = origFs }()
+
+	const fullContent = "0123456789"
+	var patchCalls int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/authenticate_device", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(tokenResponse{Success: true, Token: "fresh-token"})
+	})
+	mux.HandleFunc("/api/v1/recordings/tus/upload-123", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Upload-Offset", "0")
+			w.WriteHeader(http.StatusOK)
+		case http.MethodPatch:
+			patchCalls++
+			if patchCalls == 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if got := r.Header.Get("Authorization"); got != "fresh-token" {
+				t.Errorf("retried PATCH Authorization = %q, want fresh-token", got)
+			}
+			w.Header().Set("Upload-Offset", "10")
+			w.WriteHeader(http.StatusOK)
+		default:
+			t.Fatalf("unexpected method %s", r.Method)
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := testAPI(t, server.URL)
+	api.Client.setToken("stale-token")
+
+	r := bytes.NewReader([]byte(fullContent))
+	if err := api.ResumeUpload(context.Background(), "upload-123", r, 0); err != nil {
+		t.Fatalf("ResumeUpload: %v", err)
+	}
+	if patchCalls != 2 {
+		t.Fatalf("got %d PATCH calls, want 2 (initial 401 + retry after reauthenticate)", patchCalls)
+	}
+}